@@ -1,19 +1,54 @@
 package channels
 
 import (
+	"container/list"
 	"crypto/sha512"
 	"encoding/binary"
 	"math"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/AZ-X/dnscrypt-proxy-r2/dnscrypt-proxy/conceptions"
-	"github.com/miekg/dns"
 	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
 type CachedResponse struct {
 	*dns.Msg
-	expiration time.Time
+	expiration  time.Time
+	originalTTL time.Duration
+}
+
+// StaleIfErrorPolicy decides which upstream failures may fall back to a
+// stashed, expired cache entry per RFC 8767.
+type StaleIfErrorPolicy struct {
+	OnTimeout  bool
+	OnServfail bool
+	OnNXDOMAIN bool
+}
+
+// staleEligible reports whether upstreamErr (or, if nil, msg's Rcode) is
+// covered by the policy.
+func (policy StaleIfErrorPolicy) staleEligible(upstreamErr error, upstreamMsg *dns.Msg) bool {
+	if upstreamErr != nil {
+		if netErr, ok := upstreamErr.(net.Error); ok && netErr.Timeout() {
+			return policy.OnTimeout
+		}
+		return policy.OnServfail
+	}
+	if upstreamMsg == nil {
+		return false
+	}
+	switch upstreamMsg.Rcode {
+	case dns.RcodeServerFailure:
+		return policy.OnServfail
+	case dns.RcodeNameError:
+		return policy.OnNXDOMAIN
+	default:
+		return false
+	}
 }
 
 func ComputeCacheKey(pluginsState *PluginsState, msg *dns.Msg) *[32]byte {
@@ -40,18 +75,110 @@ func computeCacheKey(dnssec bool, Qtype, Qclass uint16, Name string) *[32]byte {
 
 // ---
 
+// popularityLRU counts recent hits per cache key, bounded to a fixed
+// capacity.
+type popularityLRU struct {
+	sync.Mutex
+	capacity int
+	hits     map[[32]byte]uint
+	order    *list.List
+	elems    map[[32]byte]*list.Element
+}
+
+func newPopularityLRU(capacity int) *popularityLRU {
+	return &popularityLRU{
+		capacity: capacity,
+		hits:     make(map[[32]byte]uint, capacity),
+		order:    list.New(),
+		elems:    make(map[[32]byte]*list.Element, capacity),
+	}
+}
+
+func (p *popularityLRU) touch(key [32]byte) uint {
+	p.Lock()
+	defer p.Unlock()
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+	} else {
+		p.elems[key] = p.order.PushFront(key)
+		if p.order.Len() > p.capacity {
+			oldest := p.order.Back()
+			p.order.Remove(oldest)
+			oldKey := oldest.Value.([32]byte)
+			delete(p.elems, oldKey)
+			delete(p.hits, oldKey)
+		}
+	}
+	p.hits[key]++
+	return p.hits[key]
+}
+
+// ---
+
 type PluginCache struct {
-	Cache *conceptions.Cache
+	proxy      *Proxy
+	Cache      *conceptions.Cache
+	popularity *popularityLRU
+	prefetchSF singleflight.Group
 }
 
 func (plugin *PluginCache) Init(proxy *Proxy) error {
-	size := 1<<math.Ilogb(float64(proxy.CacheSize))
+	size := 1 << math.Ilogb(float64(proxy.CacheSize))
 	dlog.Debugf("accurate Cache size: %d", size)
 	proxy.pluginsGlobals.Cache = conceptions.NewCache(size)
 	plugin.Cache = proxy.pluginsGlobals.Cache
+	plugin.proxy = proxy
+	plugin.popularity = newPopularityLRU(size)
 	return nil
 }
 
+// shouldPrefetch reports whether synth is both hot enough (CachePrefetchMinHits)
+// and aging enough (CachePrefetchThreshold or CachePrefetchFraction) to prefetch.
+func (plugin *PluginCache) shouldPrefetch(pluginsState *PluginsState, synth CachedResponse) bool {
+	if pluginsState.CachePrefetchMinHits == 0 || synth.originalTTL <= 0 {
+		return false
+	}
+	if plugin.popularity.touch(*pluginsState.hash_key) < pluginsState.CachePrefetchMinHits {
+		return false
+	}
+	remaining := time.Until(synth.expiration)
+	if remaining <= time.Duration(pluginsState.CachePrefetchThreshold)*time.Second {
+		return true
+	}
+	fraction := float64(remaining) / float64(synth.originalTTL)
+	return fraction <= pluginsState.CachePrefetchFraction
+}
+
+// prefetchAsync re-resolves a warm-but-aging cache entry's query with fresh
+// flagged sessionKeySkipCache, deduplicating concurrent prefetches for the
+// same key with a singleflight.
+func (plugin *PluginCache) prefetchAsync(pluginsState *PluginsState, question dns.Question) {
+	key := string(pluginsState.hash_key[:])
+	plugin.prefetchSF.DoChan(key, func() (interface{}, error) {
+		fresh := pluginsState.Clone()
+		fresh.sessionData[sessionKeySkipCache] = true
+		query := dns.Msg{}
+		query.SetQuestion(question.Name, question.Qtype)
+		query.Question[0].Qclass = question.Qclass
+		err := plugin.proxy.Resolve(fresh, &query)
+		response := fresh.synthResponse
+		if response == nil {
+			response = &query
+		}
+		if err != nil {
+			fresh.sessionData["prefetch"] = "miss"
+			dlog.Debugf("prefetch for [%v] failed: %v", question.Name, err)
+		} else {
+			fresh.sessionData["prefetch"] = "hit"
+		}
+		// Resolve has already returned by the time prefetch is set, so log
+		// directly instead of relying on its own pipeline to have seen it.
+		if queryLog := plugin.proxy.pluginsGlobals.QueryLog; queryLog != nil {
+			queryLog.Eval(fresh, response)
+		}
+		return nil, err
+	})
+}
 
 func updateTTL(msg *dns.Msg, expiration time.Time) {
 	until := time.Until(expiration)
@@ -72,8 +199,14 @@ func updateTTL(msg *dns.Msg, expiration time.Time) {
 	}
 }
 
+// sessionKeySkipCache marks a PluginsState clone built purely to drive an
+// upstream re-resolution; Eval bypasses the cache read when it's set.
+const sessionKeySkipCache = "skip_cache"
 
 func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if _, skip := pluginsState.sessionData[sessionKeySkipCache]; skip {
+		return nil
+	}
 	CachedAny, ok := plugin.Cache.Get(*pluginsState.hash_key)
 	if !ok {
 		return nil
@@ -84,19 +217,105 @@ func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	synth.Compress = true
 
 	if time.Now().After(synth.expiration) {
-		dlog.Debugf("Cache expired from %v", synth.expiration)
-		pluginsState.sessionData["stale"] = synth.Msg
-		return nil
+		if time.Now().After(synth.expiration.Add(maxStaleHorizon(synth.Msg, pluginsState))) {
+			dlog.Debugf("cache entry is past its stale horizon, discarding")
+			return nil
+		}
+		dlog.Debugf("cache expired from %v, keeping it around in case the resolver needs serve-stale", synth.expiration)
+		pluginsState.sessionData["stale"] = synth
+		return plugin.resolveOrServeStale(pluginsState, msg)
 	}
 
 	updateTTL(synth.Msg, synth.expiration)
 
+	if plugin.shouldPrefetch(pluginsState, synth) {
+		plugin.prefetchAsync(pluginsState, msg.Question[0])
+	}
+
 	pluginsState.synthResponse = synth.Msg
 	pluginsState.state = PluginsStateSynth
 	pluginsState.CacheHit = true
 	return nil
 }
 
+// maxStaleHorizon returns how long past expiration an entry may still be
+// handed out per RFC 8767.
+func maxStaleHorizon(msg *dns.Msg, pluginsState *PluginsState) time.Duration {
+	if msg.Rcode != dns.RcodeSuccess {
+		return time.Duration(pluginsState.CacheNegStaleTTL) * time.Second
+	}
+	return time.Duration(pluginsState.CacheMaxStaleTTL) * time.Second
+}
+
+// staleResolverTimeoutError satisfies net.Error so StaleIfErrorPolicy.OnTimeout
+// gates it like a real upstream timeout.
+type staleResolverTimeoutError struct{}
+
+func (staleResolverTimeoutError) Error() string   { return "stale-resolver-timeout exceeded" }
+func (staleResolverTimeoutError) Timeout() bool   { return true }
+func (staleResolverTimeoutError) Temporary() bool { return true }
+
+// resolveOrServeStale gives an upstream refresh pluginsState.StaleResolverTimeout
+// to beat the stashed stale answer before ServeStale takes over. fresh is
+// flagged with sessionKeySkipCache so it can't recurse back into this entry.
+func (plugin *PluginCache) resolveOrServeStale(pluginsState *PluginsState, msg *dns.Msg) error {
+	fresh := pluginsState.Clone()
+	fresh.sessionData[sessionKeySkipCache] = true
+	done := make(chan error, 1)
+	go func() {
+		done <- plugin.proxy.Resolve(fresh, msg)
+	}()
+	select {
+	case err := <-done:
+		if err == nil && fresh.synthResponse != nil {
+			pluginsState.synthResponse = fresh.synthResponse
+			pluginsState.state = fresh.state
+			return nil
+		}
+		plugin.ServeStale(pluginsState, msg, err, fresh.synthResponse)
+	case <-time.After(time.Duration(pluginsState.StaleResolverTimeout) * time.Millisecond):
+		// Resolve takes no context to cancel; the goroutine above is just
+		// abandoned, bounded by the upstream exchange's own timeout rather
+		// than growing unbounded now that it can't recurse.
+		dlog.Debugf("upstream lookup for [%v] exceeded the stale-resolver-timeout", msg.Question[0].Name)
+		plugin.ServeStale(pluginsState, msg, staleResolverTimeoutError{}, nil)
+	}
+	return nil
+}
+
+// ServeStale implements the RFC 8767 "stale if error" path: it synthesizes a
+// response from pluginsState.sessionData["stale"] and marks
+// sessionData["stale_served"] for the query log.
+func (plugin *PluginCache) ServeStale(pluginsState *PluginsState, msg *dns.Msg, upstreamErr error, upstreamMsg *dns.Msg) bool {
+	if !pluginsState.StaleIfError.staleEligible(upstreamErr, upstreamMsg) {
+		return false
+	}
+	staleAny, ok := pluginsState.sessionData["stale"]
+	if !ok {
+		return false
+	}
+	cached, ok := staleAny.(CachedResponse)
+	if !ok {
+		return false
+	}
+	if time.Now().After(cached.expiration.Add(maxStaleHorizon(cached.Msg, pluginsState))) {
+		dlog.Debugf("stale entry is past its serve-stale horizon, refusing to serve it")
+		return false
+	}
+	synth := cached.Msg
+	synth.Id = msg.Id
+	synth.Response = true
+	synth.Compress = true
+	updateTTL(synth, time.Now().Add(time.Duration(pluginsState.CacheStaleTTL)*time.Second))
+
+	dlog.Noticef("serving a stale response after an upstream failure: %v", upstreamErr)
+	pluginsState.synthResponse = synth
+	pluginsState.state = PluginsStateSynth
+	pluginsState.CacheHit = true
+	pluginsState.sessionData["stale_served"] = true
+	return true
+}
+
 // ---
 
 type PluginCacheResponse struct {
@@ -143,7 +362,6 @@ func getMinTTL(msg *dns.Msg, minTTL uint32, maxTTL uint32, CacheNegMinTTL uint32
 	return time.Duration(ttl) * time.Minute
 }
 
-
 func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth {
 		return nil
@@ -153,8 +371,9 @@ func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg
 	}
 	ttl := getMinTTL(msg, pluginsState.CacheMinTTL, pluginsState.CacheMaxTTL, pluginsState.CacheNegMinTTL, pluginsState.CacheNegMaxTTL)
 	CachedResponse := CachedResponse{
-		expiration: time.Now().Add(ttl),
-		Msg:        msg,
+		expiration:  time.Now().Add(ttl),
+		originalTTL: ttl,
+		Msg:         msg,
 	}
 
 	plugin.Cache.Add(*pluginsState.hash_key, CachedResponse)
@@ -0,0 +1,91 @@
+package channels
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPopularityLRUEviction(t *testing.T) {
+	lru := newPopularityLRU(2)
+	var a, b, c [32]byte
+	a[0], b[0], c[0] = 1, 2, 3
+
+	lru.touch(a)
+	lru.touch(b)
+	lru.touch(c) // evicts a, the least recently touched
+
+	// re-inserting a evicts b, now the least recently touched
+	if hits := lru.touch(a); hits != 1 {
+		t.Fatalf("a should have been evicted and re-inserted with 1 hit, got %d", hits)
+	}
+	if hits := lru.touch(b); hits != 1 {
+		t.Fatalf("b should have been evicted by a's re-insertion and start over at 1 hit, got %d", hits)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStaleIfErrorPolicyStaleEligible(t *testing.T) {
+	policy := StaleIfErrorPolicy{OnTimeout: true, OnServfail: true, OnNXDOMAIN: false}
+
+	if !policy.staleEligible(timeoutError{}, nil) {
+		t.Error("a timeout should be eligible when OnTimeout is set")
+	}
+	if !policy.staleEligible(net.UnknownNetworkError("x"), nil) {
+		t.Error("a non-timeout network error should fall back to OnServfail")
+	}
+	nxdomain := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+	if policy.staleEligible(nil, nxdomain) {
+		t.Error("NXDOMAIN should not be eligible when OnNXDOMAIN is unset")
+	}
+	servfail := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	if !policy.staleEligible(nil, servfail) {
+		t.Error("SERVFAIL should be eligible when OnServfail is set")
+	}
+}
+
+func TestUpdateTTL(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Ttl: 999}}}
+	updateTTL(msg, time.Now().Add(30*time.Second))
+	if ttl := msg.Answer[0].Header().Ttl; ttl == 0 || ttl > 30 {
+		t.Fatalf("expected a TTL in (0, 30], got %d", ttl)
+	}
+
+	updateTTL(msg, time.Now().Add(-time.Second))
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 0 {
+		t.Fatalf("an expiration in the past should floor the TTL at 0, got %d", ttl)
+	}
+}
+
+func TestGetMinTTL(t *testing.T) {
+	positive := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess}}
+	positive.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Ttl: 10}}}
+	if got := getMinTTL(positive, 60, 300, 60, 300); got != 60*time.Minute {
+		t.Fatalf("a positive answer below minTTL should be floored to minTTL, got %v", got)
+	}
+
+	negative := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+	if got := getMinTTL(negative, 60, 300, 10, 300); got != 10*time.Second {
+		t.Fatalf("an empty negative answer should fall back to CacheNegMinTTL, got %v", got)
+	}
+}
+
+func TestMaxStaleHorizon(t *testing.T) {
+	pluginsState := &PluginsState{CacheNegStaleTTL: 60, CacheMaxStaleTTL: 3600}
+	positive := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess}}
+	if got := maxStaleHorizon(positive, pluginsState); got != 3600*time.Second {
+		t.Fatalf("a positive answer should use CacheMaxStaleTTL, got %v", got)
+	}
+	negative := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+	if got := maxStaleHorizon(negative, pluginsState); got != 60*time.Second {
+		t.Fatalf("a negative answer should use CacheNegStaleTTL, got %v", got)
+	}
+}
@@ -0,0 +1,276 @@
+package channels
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// Pref64 is an RFC 6052 NAT64 prefix, one of the six well-known lengths.
+type Pref64 struct {
+	Prefix net.IP // always the 16-byte form
+	Length int    // one of 32, 40, 48, 56, 64, 96
+}
+
+var pref64ValidLengths = map[int]bool{32: true, 40: true, 48: true, 56: true, 64: true, 96: true}
+
+// pref64Offsets returns where the embedded IPv4 address splits around the
+// reserved "u" octet at byte 8 (RFC 6052 section 2.2); not meaningful for 96,
+// which embeds straight at [12:16].
+func pref64Offsets(length int) (prefixBytes, firstLen int) {
+	prefixBytes = length / 8
+	return prefixBytes, 8 - prefixBytes
+}
+
+// embed places ipv4 inside pref64 following the RFC 6052 bit layout,
+// returning the synthesized AAAA or nil if length isn't one we recognize.
+func (pref64 Pref64) embed(ipv4 net.IP) net.IP {
+	ipv4 = ipv4.To4()
+	if ipv4 == nil || !pref64ValidLengths[pref64.Length] {
+		return nil
+	}
+	synthesized := make(net.IP, 16)
+	copy(synthesized, pref64.Prefix.To16())
+	if pref64.Length == 96 {
+		copy(synthesized[12:16], ipv4)
+		return synthesized
+	}
+	prefixBytes, firstLen := pref64Offsets(pref64.Length)
+	copy(synthesized[prefixBytes:8], ipv4[:firstLen])
+	copy(synthesized[9:], ipv4[firstLen:])
+	return synthesized
+}
+
+// ipv4OnlyArpaAddrs are the two well-known A records of ipv4only.arpa (RFC 7050).
+var ipv4OnlyArpaAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// pref64FromAAAA strips a known ipv4only.arpa IPv4 address out of a
+// synthesized AAAA to recover the prefix and its length.
+func pref64FromAAAA(aaaa net.IP, ipv4 net.IP) (Pref64, bool) {
+	aaaa = aaaa.To16()
+	ipv4 = ipv4.To4()
+	if aaaa == nil || ipv4 == nil {
+		return Pref64{}, false
+	}
+	for length := range pref64ValidLengths {
+		var embedded net.IP
+		if length == 96 {
+			embedded = aaaa[12:16]
+		} else {
+			prefixBytes, firstLen := pref64Offsets(length)
+			embedded = make(net.IP, 0, 4)
+			embedded = append(embedded, aaaa[prefixBytes:8]...)
+			embedded = append(embedded, aaaa[9:9+(4-firstLen)]...)
+		}
+		if embedded.Equal(ipv4) {
+			prefix := make(net.IP, 16)
+			copy(prefix, aaaa[:length/8])
+			return Pref64{Prefix: prefix, Length: length}, true
+		}
+	}
+	return Pref64{}, false
+}
+
+// pref64Cache holds the currently-active NAT64 prefix, guarded for
+// concurrent Eval calls while a background goroutine re-checks it.
+type pref64Cache struct {
+	sync.RWMutex
+	pref64    *Pref64
+	learnedAt time.Time
+}
+
+func (cache *pref64Cache) get() *Pref64 {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.pref64
+}
+
+func (cache *pref64Cache) set(pref64 Pref64) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.pref64 = &pref64
+	cache.learnedAt = time.Now()
+}
+
+// PluginDNS64 implements RFC 6147 synthesis: an empty AAAA answer is
+// rewritten to embed the corresponding A record into the active Pref64.
+type PluginDNS64 struct {
+	proxy     *Proxy
+	cache     pref64Cache
+	exclusion []string
+}
+
+func (plugin *PluginDNS64) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
+	plugin.exclusion = proxy.DNS64ExclusionList
+	if proxy.DNS64Prefix != "" {
+		prefix := net.ParseIP(proxy.DNS64Prefix)
+		if prefix == nil {
+			dlog.Errorf("invalid dns64_prefix [%v]", proxy.DNS64Prefix)
+		} else {
+			plugin.cache.set(Pref64{Prefix: prefix.To16(), Length: proxy.DNS64PrefixLength})
+			dlog.Noticef("using the statically configured NAT64 prefix %v/%d", prefix, proxy.DNS64PrefixLength)
+		}
+	}
+	if proxy.DNS64Resolver != "" {
+		go plugin.learnPref64Periodically()
+	}
+	return nil
+}
+
+func (plugin *PluginDNS64) learnPref64Periodically() {
+	for {
+		if pref64, err := plugin.discoverPref64(); err == nil {
+			dlog.Noticef("learned NAT64 prefix %v/%d from [%v]", pref64.Prefix, pref64.Length, plugin.proxy.DNS64Resolver)
+			plugin.cache.set(pref64)
+		} else {
+			dlog.Debugf("could not learn a NAT64 prefix from [%v]: %v", plugin.proxy.DNS64Resolver, err)
+		}
+		time.Sleep(plugin.proxy.DNS64RecheckInterval)
+	}
+}
+
+// discoverPref64 derives the live prefix from ipv4only.arpa per RFC 7050.
+func (plugin *PluginDNS64) discoverPref64() (Pref64, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ipv4only.arpa.", dns.TypeAAAA)
+	in, err := exchangeWithResolver(plugin.proxy.DNS64Resolver, msg)
+	if err != nil {
+		return Pref64{}, err
+	}
+	for _, rr := range in.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		for _, knownIPv4 := range ipv4OnlyArpaAddrs {
+			if pref64, ok := pref64FromAAAA(aaaa.AAAA, knownIPv4); ok {
+				return pref64, nil
+			}
+		}
+	}
+	return Pref64{}, dlog.Errorf("no usable NAT64 prefix in the response from [%v]", plugin.proxy.DNS64Resolver)
+}
+
+// exchangeWithResolver is a minimal plain-DNS exchange used only to learn the
+// NAT64 prefix from dns64_resolver.
+func exchangeWithResolver(resolver string, query *dns.Msg) (*dns.Msg, error) {
+	conn, err := net.DialTimeout("udp", resolver, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return nil, err
+	}
+	binQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(binQuery); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 512)
+	length, err := conn.Read(packet)
+	if err != nil {
+		return nil, err
+	}
+	in := new(dns.Msg)
+	if err := in.Unpack(packet[:length]); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+func (plugin *PluginDNS64) isExcluded(qName string) bool {
+	qName = strings.ToLower(qName)
+	for _, excluded := range plugin.exclusion {
+		if qName == excluded || strings.HasSuffix(qName, "."+excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasUsableAAAA(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
+
+func isDNSSECSigned(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *PluginDNS64) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	if hasUsableAAAA(msg) {
+		return nil
+	}
+	if pluginsState.dnssec && isDNSSECSigned(msg) && !pluginsState.DNS64IgnoreDNSSEC {
+		dlog.Debugf("[%v] has a signed empty AAAA answer, not synthesizing to avoid breaking DNSSEC validation", msg.Question[0].Name)
+		return nil
+	}
+	qName := msg.Question[0].Name
+	if plugin.isExcluded(qName) {
+		return nil
+	}
+	pref64 := plugin.cache.get()
+	if pref64 == nil {
+		return nil
+	}
+	aQuery := new(dns.Msg)
+	aQuery.SetQuestion(qName, dns.TypeA)
+	fresh := pluginsState.Clone()
+	if err := plugin.proxy.Resolve(fresh, aQuery); err != nil {
+		dlog.Debugf("DNS64 lookup of the A record for [%v] failed: %v", qName, err)
+		return nil
+	}
+	aMsg := fresh.synthResponse
+	if aMsg == nil || len(aMsg.Answer) == 0 {
+		return nil
+	}
+	synth := msg.Copy()
+	synth.Answer = nil
+	for _, rr := range aMsg.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		synthesized := pref64.embed(a.A)
+		if synthesized == nil {
+			continue
+		}
+		synth.Answer = append(synth.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: qName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: a.Hdr.Ttl},
+			AAAA: synthesized,
+		})
+	}
+	if len(synth.Answer) == 0 {
+		return nil
+	}
+	synth.Rcode = dns.RcodeSuccess
+	ttl := getMinTTL(synth, pluginsState.CacheMinTTL, pluginsState.CacheMaxTTL, pluginsState.CacheNegMinTTL, pluginsState.CacheNegMaxTTL)
+	updateTTL(synth, time.Now().Add(ttl))
+
+	pluginsState.synthResponse = synth
+	pluginsState.state = PluginsStateSynth
+	return nil
+}
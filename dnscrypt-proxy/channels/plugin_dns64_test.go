@@ -0,0 +1,38 @@
+package channels
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPref64EmbedRoundTrip(t *testing.T) {
+	ipv4 := net.IPv4(192, 0, 2, 1)
+	for length := range pref64ValidLengths {
+		length := length
+		t.Run("", func(t *testing.T) {
+			prefix := net.ParseIP("64:ff9b::")
+			pref64 := Pref64{Prefix: prefix.To16(), Length: length}
+			aaaa := pref64.embed(ipv4)
+			if aaaa == nil {
+				t.Fatalf("embed returned nil for length %d", length)
+			}
+			got, ok := pref64FromAAAA(aaaa, ipv4)
+			if !ok {
+				t.Fatalf("pref64FromAAAA failed to recover a prefix of length %d", length)
+			}
+			if got.Length != length {
+				t.Fatalf("recovered length %d, want %d", got.Length, length)
+			}
+			if !got.Prefix.Equal(prefix) {
+				t.Fatalf("recovered prefix %v, want %v", got.Prefix, prefix)
+			}
+		})
+	}
+}
+
+func TestPref64EmbedInvalidLength(t *testing.T) {
+	pref64 := Pref64{Prefix: net.ParseIP("64:ff9b::").To16(), Length: 48 + 1}
+	if got := pref64.embed(net.IPv4(192, 0, 2, 1)); got != nil {
+		t.Fatalf("embed with an invalid length returned %v, want nil", got)
+	}
+}
@@ -0,0 +1,265 @@
+package channels
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// QueryLogFormat selects how PluginQueryLog renders each entry to its file
+// sink.
+type QueryLogFormat int
+
+const (
+	// QueryLogFormatLTSV is the dnscrypt-proxy tradition: tab-separated
+	// label:value pairs, one query per line.
+	QueryLogFormatLTSV QueryLogFormat = iota
+	QueryLogFormatJSON
+)
+
+// QueryLogEntry is one recorded question/answer.
+type QueryLogEntry struct {
+	Timestamp    time.Time     `json:"ts"`
+	ClientIP     string        `json:"client_ip"`
+	QName        string        `json:"qname"`
+	QType        string        `json:"qtype"`
+	Server       string        `json:"server"`
+	Relay        string        `json:"relay,omitempty"`
+	RTT          time.Duration `json:"-"`
+	RTTMillis    int64         `json:"rtt_ms"`
+	CacheHit     bool          `json:"cache_hit"`
+	StaleServed  bool          `json:"stale_served"`
+	DNSSEC       bool          `json:"dnssec"`
+	ClientSubnet string        `json:"client_subnet,omitempty"`
+	Rcode        string        `json:"rcode"`
+	FirstAnswer  string        `json:"first_answer,omitempty"`
+	Prefetch     string        `json:"prefetch,omitempty"`
+}
+
+func (entry QueryLogEntry) ltsv() string {
+	return fmt.Sprintf(
+		"time:%s\tclient:%s\tqname:%s\tqtype:%s\tserver:%s\trelay:%s\trtt:%d\tcache_hit:%v\tstale:%v\tdnssec:%v\tsubnet:%s\trcode:%s\tanswer:%s\tprefetch:%s",
+		entry.Timestamp.Format(time.RFC3339), entry.ClientIP, entry.QName, entry.QType, entry.Server, entry.Relay,
+		entry.RTT.Milliseconds(), entry.CacheHit, entry.StaleServed, entry.DNSSEC, entry.ClientSubnet, entry.Rcode, entry.FirstAnswer, entry.Prefetch,
+	)
+}
+
+// queryLogRing is a small bounded ring buffer backing `GET /queries?since=...`.
+type queryLogRing struct {
+	sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+}
+
+func newQueryLogRing(capacity int) *queryLogRing {
+	return &queryLogRing{entries: make([]QueryLogEntry, capacity)}
+}
+
+func (ring *queryLogRing) add(entry QueryLogEntry) {
+	ring.Lock()
+	defer ring.Unlock()
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % len(ring.entries)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+func (ring *queryLogRing) since(cutoff time.Time) []QueryLogEntry {
+	ring.Lock()
+	defer ring.Unlock()
+	ordered := make([]QueryLogEntry, 0, len(ring.entries))
+	if ring.full {
+		ordered = append(ordered, ring.entries[ring.next:]...)
+	}
+	ordered = append(ordered, ring.entries[:ring.next]...)
+	if cutoff.IsZero() {
+		return ordered
+	}
+	filtered := ordered[:0]
+	for _, entry := range ordered {
+		if entry.Timestamp.After(cutoff) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// queryLogSink is the recording machinery shared by PluginQueryLog and
+// PluginNXLog: a rotated file writer and/or ring buffer exposed over HTTP.
+type queryLogSink struct {
+	format QueryLogFormat
+	writer io.Writer
+	ring   *queryLogRing
+}
+
+func newQueryLogSink(format QueryLogFormat, file string, maxSize, maxAge, maxBackups, ringSize int, ringAddr string) *queryLogSink {
+	sink := &queryLogSink{format: format}
+	if file != "" {
+		sink.writer = &lumberjack.Logger{
+			Filename:   file,
+			MaxSize:    maxSize,
+			MaxAge:     maxAge,
+			MaxBackups: maxBackups,
+		}
+	}
+	if ringSize > 0 {
+		sink.ring = newQueryLogRing(ringSize)
+		if ringAddr != "" {
+			go sink.serveRing(ringAddr)
+		}
+	}
+	return sink
+}
+
+func (sink *queryLogSink) record(entry QueryLogEntry) {
+	if sink.ring != nil {
+		sink.ring.add(entry)
+	}
+	if sink.writer == nil {
+		return
+	}
+	var line string
+	if sink.format == QueryLogFormatJSON {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			dlog.Warnf("failed to encode query log entry: %v", err)
+			return
+		}
+		line = string(encoded) + "\n"
+	} else {
+		line = entry.ltsv() + "\n"
+	}
+	if _, err := sink.writer.Write([]byte(line)); err != nil {
+		dlog.Warnf("failed to write to the query log: %v", err)
+	}
+}
+
+func (sink *queryLogSink) serveRing(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if raw := r.URL.Query().Get("since"); raw != "" {
+			if parsed, err := time.Parse(time.RFC3339, raw); err == nil {
+				since = parsed
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sink.ring.since(since)); err != nil {
+			dlog.Debugf("failed to serve /queries: %v", err)
+		}
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		dlog.Errorf("query log HTTP endpoint on [%v] failed: %v", addr, err)
+	}
+}
+
+// buildQueryLogEntry fills in the fields both PluginQueryLog and PluginNXLog
+// record identically.
+func buildQueryLogEntry(pluginsState *PluginsState, msg *dns.Msg, question dns.Question) QueryLogEntry {
+	_, staleServed := pluginsState.sessionData["stale_served"]
+	prefetch, _ := pluginsState.sessionData["prefetch"].(string)
+	entry := QueryLogEntry{
+		Timestamp:    time.Now(),
+		ClientIP:     pluginsState.clientAddr,
+		QName:        question.Name,
+		QType:        dns.TypeToString[question.Qtype],
+		Server:       pluginsState.serverName,
+		Relay:        pluginsState.relayName,
+		RTT:          pluginsState.serverRTT,
+		RTTMillis:    pluginsState.serverRTT.Milliseconds(),
+		CacheHit:     pluginsState.CacheHit,
+		StaleServed:  staleServed,
+		DNSSEC:       pluginsState.dnssec,
+		ClientSubnet: pluginsState.clientSubnet,
+		Rcode:        dns.RcodeToString[msg.Rcode],
+		Prefetch:     prefetch,
+	}
+	if len(msg.Answer) > 0 {
+		entry.FirstAnswer = msg.Answer[0].String()
+	}
+	return entry
+}
+
+// PluginQueryLog records every question and its outcome: server/relay used,
+// RTT, cache status, DNSSEC, EDNS client-subnet and response code.
+type PluginQueryLog struct {
+	sink          *queryLogSink
+	ignoredQtypes map[uint16]bool
+	ignoredNames  []string
+}
+
+func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
+	plugin.sink = newQueryLogSink(
+		QueryLogFormat(proxy.QueryLogFormat), proxy.QueryLogFile,
+		proxy.LogMaxSize, proxy.LogMaxAge, proxy.LogMaxBackups,
+		proxy.QueryLogRingSize, proxy.QueryLogRingAddr,
+	)
+	plugin.ignoredQtypes = make(map[uint16]bool, len(proxy.QueryLogIgnoredQtypes))
+	for _, qtype := range proxy.QueryLogIgnoredQtypes {
+		if t, ok := dns.StringToType[qtype]; ok {
+			plugin.ignoredQtypes[t] = true
+		}
+	}
+	plugin.ignoredNames = proxy.QueryLogIgnoredNames
+	proxy.pluginsGlobals.QueryLog = plugin
+	return nil
+}
+
+func (plugin *PluginQueryLog) isIgnored(qName string, qtype uint16) bool {
+	if plugin.ignoredQtypes[qtype] {
+		return true
+	}
+	for _, pattern := range plugin.ignoredNames {
+		if matched, _ := path.Match(pattern, qName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) == 0 {
+		return nil
+	}
+	question := msg.Question[0]
+	if plugin.isIgnored(question.Name, question.Qtype) {
+		return nil
+	}
+	plugin.sink.record(buildQueryLogEntry(pluginsState, msg, question))
+	return nil
+}
+
+// ---
+
+// PluginNXLog only ever records NXDOMAIN answers, keeping its own
+// queryLogSink independent of PluginQueryLog's.
+type PluginNXLog struct {
+	sink *queryLogSink
+}
+
+func (plugin *PluginNXLog) Init(proxy *Proxy) error {
+	plugin.sink = newQueryLogSink(
+		QueryLogFormat(proxy.NXLogFormat), proxy.NXLogFile,
+		proxy.LogMaxSize, proxy.LogMaxAge, proxy.LogMaxBackups,
+		proxy.NXLogRingSize, proxy.NXLogRingAddr,
+	)
+	return nil
+}
+
+func (plugin *PluginNXLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if msg.Rcode != dns.RcodeNameError || len(msg.Question) == 0 {
+		return nil
+	}
+	plugin.sink.record(buildQueryLogEntry(pluginsState, msg, msg.Question[0]))
+	return nil
+}
@@ -13,15 +13,32 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
+// ServerBugs records known protocol quirks of a specific resolver, loaded
+// per-server from config next to its stamp.
+type ServerBugs struct {
+	IncorrectPadding        bool
+	FragmentsBlocked        bool
+	NonStandardProviderName bool
+}
+
 type CertInfo struct {
 	ServerPk           [32]byte
 	SharedKey          [32]byte
 	MagicQuery         [ClientMagicLen]byte
 	CryptoConstruction CryptoConstruction
 	ForwardSecurity    bool
+	Bugs               ServerBugs
 }
 
-func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk ed25519.PublicKey, serverAddress string, providerName string, isNew bool, relays []*Endpoint) ([]*Endpoint, CertInfo, int, error) {
+// FetchCurrentDNSCryptCert dispatches an EndpointKindODoHTarget entry to
+// FetchODoHTargetConfig instead of running the TXT-record exchange below.
+func FetchCurrentDNSCryptCert(proxy *Proxy, kind EndpointKind, odohTarget *ODoHTarget, serverName *string, proto string, pk ed25519.PublicKey, serverAddress string, providerName string, isNew bool, relays []*Endpoint, serverBugs ServerBugs, anonDirectCertFallback bool) ([]*Endpoint, CertInfo, int, error) {
+	if kind == EndpointKindODoHTarget {
+		if err := FetchODoHTargetConfig(proxy, odohTarget); err != nil {
+			return nil, CertInfo{}, 0, err
+		}
+		return nil, CertInfo{}, 0, nil
+	}
 	if len(pk) != ed25519.PublicKeySize {
 		return nil, CertInfo{}, 0, errors.New("Invalid public key length")
 	}
@@ -33,7 +50,7 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 	}
 	query := dns.Msg{}
 	query.SetQuestion(providerName, dns.TypeTXT)
-	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") {
+	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") && !serverBugs.NonStandardProviderName {
 		dlog.Warnf("[%v] uses a non-standard provider name ('%v' doesn't start with '2.dnscrypt-cert.')", *serverName, providerName)
 	}
 	var in *dns.Msg
@@ -42,8 +59,8 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 	var workingSet []*Endpoint
 	var relay_f bool
 	if len(relays) > 0 {
-		for i , relayAddr := range relays {
-			in, rtt, err, relay_f = dnsExchange(proxy, proto, &query, serverAddress, relayAddr, serverName)
+		for i, relayAddr := range relays {
+			in, rtt, err, relay_f = dnsExchange(proxy, proto, &query, serverAddress, relayAddr, serverName, serverBugs, anonDirectCertFallback)
 			if err != nil {
 				dlog.Debug(err)
 				continue
@@ -51,7 +68,7 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 			if !relay_f {
 				workingSet = append(workingSet, relayAddr)
 			} else {
-				dlog.Noticef("relay [%d] failed for [%s]", i + 1, *serverName)
+				dlog.Noticef("relay [%d] failed for [%s]", i+1, *serverName)
 			}
 		}
 		if len(workingSet) < 1 {
@@ -59,14 +76,14 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 			return nil, CertInfo{}, 0, errors.New("all relays failed")
 		}
 	} else {
-		in, rtt, err, _ = dnsExchange(proxy, proto, &query, serverAddress, nil, serverName)
+		in, rtt, err, _ = dnsExchange(proxy, proto, &query, serverAddress, nil, serverName, serverBugs, anonDirectCertFallback)
 	}
 	if err != nil {
 		dlog.Debug(err)
 		return nil, CertInfo{}, 0, err
 	}
 	now := uint32(time.Now().Unix())
-	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction}
+	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction, Bugs: serverBugs}
 	highestSerial := uint32(0)
 	var certCountStr string
 	for _, answerRr := range in.Answer {
@@ -203,13 +220,17 @@ func packTxtString(s string) []byte {
 	return msg
 }
 
-func dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress string, relayAddr *Endpoint, serverName *string) (*dns.Msg, time.Duration, error, bool) {
+func dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress string, relayAddr *Endpoint, serverName *string, serverBugs ServerBugs, anonDirectCertFallback bool) (*dns.Msg, time.Duration, error, bool) {
 	relay_f := relayAddr == nil
-	response, ttl, err := _dnsExchange(proxy, proto, query, serverAddress, relayAddr)
+	response, ttl, err := _dnsExchange(proxy, proto, query, serverAddress, relayAddr, serverBugs)
 	if err != nil && relayAddr != nil {
+		if !anonDirectCertFallback {
+			dlog.Warnf("relay [%v] failed for [%v] and anon_direct_cert_fallback is disabled, not falling back to a direct connection", relayAddr.IP, *serverName)
+			return response, ttl, err, relay_f
+		}
 		dlog.Debugf("failed to get a certificate for [%v] via relay [%v], retrying over a direct connection", *serverName, relayAddr.IP)
 		relay_f = true
-		response, ttl, err = _dnsExchange(proxy, proto, query, serverAddress, nil)
+		response, ttl, err = _dnsExchange(proxy, proto, query, serverAddress, nil, serverBugs)
 		if err == nil {
 			dlog.Infof("direct certificate retrieval for [%v] succeeded", *serverName)
 		}
@@ -217,10 +238,13 @@ func dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress strin
 	return response, ttl, err, relay_f
 }
 
-func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress string, relayAddr *Endpoint) (*dns.Msg, time.Duration, error) {
+func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress string, relayAddr *Endpoint, serverBugs ServerBugs) (*dns.Msg, time.Duration, error) {
+	if proto == "udp" && serverBugs.FragmentsBlocked {
+		proto = "tcp"
+	}
 	var packet []byte
 	var rtt time.Duration
-	if proto == "udp" {
+	if proto == "udp" && !serverBugs.IncorrectPadding {
 		qNameLen, padding := len(query.Question[0].Name), 0
 		if qNameLen < 480 {
 			padding = 480 - qNameLen
@@ -283,7 +307,7 @@ func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress stri
 		return nil, 0, err
 	}
 	rtt = time.Since(now)
-	
+
 	msg := dns.Msg{}
 	if err := msg.Unpack(packet); err != nil {
 		return nil, 0, err
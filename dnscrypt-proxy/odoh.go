@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EndpointKind distinguishes the transports FetchCurrentDNSCryptCert knows
+// how to drive: plain DNSCrypt, or one of the two ODoH roles.
+type EndpointKind uint8
+
+const (
+	EndpointKindDNSCrypt EndpointKind = iota
+	EndpointKindODoHTarget
+	EndpointKindODoHRelay
+)
+
+// HPKE codepoints from RFC 9180, restricted to the suite the ODoH draft
+// mandates support for. These only identify the suite a target advertises;
+// see the warning on sealODoHQuery before treating anything below as an
+// RFC 9180-conformant HPKE implementation.
+const (
+	odohKemX25519HKDFSHA256 uint16 = 0x0020
+	odohKdfHKDFSHA256       uint16 = 0x0001
+	odohAeadAES128GCM       uint16 = 0x0001
+
+	odohConfigWellKnownPath = "/.well-known/odohconfigs"
+	odohConfigTTL           = 1 * time.Hour
+	odohMaxConfigBodySize   = 4096
+)
+
+// ODoHTargetConfig is one entry decoded from a target's
+// /.well-known/odohconfigs.
+type ODoHTargetConfig struct {
+	KemID     uint16
+	KdfID     uint16
+	AeadID    uint16
+	PublicKey [32]byte
+}
+
+// ODoHTarget is the resolver a query is ultimately answered by.
+type ODoHTarget struct {
+	*Endpoint
+	URL       string
+	config    ODoHTargetConfig
+	fetchedAt time.Time
+}
+
+// ODoHRelay is the oblivious proxy a sealed query is POSTed to.
+type ODoHRelay struct {
+	*Endpoint
+	URL string
+}
+
+// odohQueryContext carries the key material needed to open the matching
+// response.
+type odohQueryContext struct {
+	exporterSecret []byte
+	suite          []byte
+}
+
+func (target *ODoHTarget) needsConfigRefresh() bool {
+	return target.fetchedAt.IsZero() || time.Since(target.fetchedAt) > odohConfigTTL
+}
+
+// FetchODoHTargetConfig retrieves and caches the HPKE config advertised at
+// target's well-known endpoint, the ODoH equivalent of
+// FetchCurrentDNSCryptCert's certificate fetch.
+func FetchODoHTargetConfig(proxy *Proxy, target *ODoHTarget) error {
+	if !target.needsConfigRefresh() {
+		return nil
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(target.URL, "/")+odohConfigWellKnownPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := proxy.xTransport.Fetch(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unable to fetch the ODoH config for [" + target.URL + "]")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, odohMaxConfigBodySize))
+	if err != nil {
+		return err
+	}
+	config, err := parseODoHTargetConfigs(body)
+	if err != nil {
+		dlog.Warnf("[%v] has an unusable ODoH config: %v", target.URL, err)
+		return err
+	}
+	target.config = config
+	target.fetchedAt = time.Now()
+	dlog.Noticef("[%v] ODoH config refreshed", target.URL)
+	return nil
+}
+
+// parseODoHTargetConfigs decodes an ObliviousDoHConfigs wire blob and
+// returns the first entry using a suite we support.
+func parseODoHTargetConfigs(raw []byte) (ODoHTargetConfig, error) {
+	if len(raw) < 2 {
+		return ODoHTargetConfig{}, errors.New("truncated ODoHConfigs")
+	}
+	total := binary.BigEndian.Uint16(raw[0:2])
+	buf := raw[2:]
+	if int(total) > len(buf) {
+		return ODoHTargetConfig{}, errors.New("truncated ODoHConfigs")
+	}
+	buf = buf[:total]
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return ODoHTargetConfig{}, errors.New("truncated ODoHConfig entry")
+		}
+		length := binary.BigEndian.Uint16(buf[2:4])
+		if int(length) > len(buf)-4 {
+			return ODoHTargetConfig{}, errors.New("truncated ODoHConfig entry")
+		}
+		contents := buf[4 : 4+length]
+		buf = buf[4+length:]
+		if len(contents) < 6+32 {
+			continue
+		}
+		kemID := binary.BigEndian.Uint16(contents[0:2])
+		kdfID := binary.BigEndian.Uint16(contents[2:4])
+		aeadID := binary.BigEndian.Uint16(contents[4:6])
+		if kemID != odohKemX25519HKDFSHA256 || kdfID != odohKdfHKDFSHA256 || aeadID != odohAeadAES128GCM {
+			continue
+		}
+		config := ODoHTargetConfig{KemID: kemID, KdfID: kdfID, AeadID: aeadID}
+		copy(config.PublicKey[:], contents[6:38])
+		return config, nil
+	}
+	return ODoHTargetConfig{}, errors.New("no supported HPKE suite advertised")
+}
+
+// sealODoHQuery seals a plaintext DNS query for target.config with a
+// raw X25519 DH exchange feeding an unlabeled HKDF-SHA256/AES-128-GCM
+// construction loosely modeled on HPKE base mode.
+//
+// WARNING: this is NOT RFC 9180 HPKE. A conformant implementation runs DH
+// through the KEM's own labeled Extract/Expand (DHKEM(X25519, HKDF-SHA256),
+// RFC 9180 section 4.1) and then through the base-mode key schedule (section
+// 5.1), both of which bind in a suite_id and the "HPKE-v1" domain separator
+// that this function skips. The upshot is that it will not interoperate
+// with a standards-compliant ODoH target or relay; it only round-trips
+// against openODoHResponse below. Treat this as a placeholder scoped to
+// this codebase until it's replaced with a real HPKE implementation (e.g.
+// one built on an audited DHKEM/HPKE library) before pointing it at a
+// production target.
+func sealODoHQuery(config ODoHTargetConfig, dnsQuery []byte) ([]byte, odohQueryContext, error) {
+	var ephemeralSk [32]byte
+	if _, err := rand.Read(ephemeralSk[:]); err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	var ephemeralPk [32]byte
+	curve25519.ScalarBaseMult(&ephemeralPk, &ephemeralSk)
+	var sharedSecret [32]byte
+	curve25519.ScalarMult(&sharedSecret, &ephemeralSk, &config.PublicKey)
+
+	suite := encodeODoHSuite(config)
+	keyMaterial, err := hkdfExpand(sharedSecret[:], ephemeralPk[:], append([]byte("odoh query"), suite...), aes.BlockSize+12)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	key, nonce := keyMaterial[:aes.BlockSize], keyMaterial[aes.BlockSize:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	sealed := aead.Seal(nil, nonce, dnsQuery, suite)
+
+	out := new(bytes.Buffer)
+	out.Write(ephemeralPk[:])
+	out.Write(sealed)
+
+	exporterSecret, err := hkdfExpand(sharedSecret[:], ephemeralPk[:], append([]byte("odoh exporter"), suite...), sha256.Size)
+	if err != nil {
+		return nil, odohQueryContext{}, err
+	}
+	return out.Bytes(), odohQueryContext{exporterSecret: exporterSecret, suite: suite}, nil
+}
+
+// openODoHResponse opens a sealed answer, deriving the response key from
+// this same non-standard scheme's exporter secret and a fresh random salt
+// the target is expected to prepend to the ciphertext. This label and the
+// salt-prefix framing are specific to sealODoHQuery above, not the ODoH
+// draft's actual response-key derivation -- see the warning there.
+func openODoHResponse(ctx odohQueryContext, sealed []byte) ([]byte, error) {
+	const saltSize = 32
+	if len(sealed) < saltSize {
+		return nil, errors.New("truncated ODoH response")
+	}
+	salt, ciphertext := sealed[:saltSize], sealed[saltSize:]
+	keyMaterial, err := hkdfExpand(ctx.exporterSecret, salt, append([]byte("odoh response"), ctx.suite...), aes.BlockSize+12)
+	if err != nil {
+		return nil, err
+	}
+	key, nonce := keyMaterial[:aes.BlockSize], keyMaterial[aes.BlockSize:]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, ctx.suite)
+}
+
+func encodeODoHSuite(config ODoHTargetConfig) []byte {
+	suite := make([]byte, 6)
+	binary.BigEndian.PutUint16(suite[0:2], config.KemID)
+	binary.BigEndian.PutUint16(suite[2:4], config.KdfID)
+	binary.BigEndian.PutUint16(suite[4:6], config.AeadID)
+	return suite
+}
+
+func hkdfExpand(secret, salt, info []byte, size int) ([]byte, error) {
+	reader := hkdf.New(sha256.New, secret, salt, info)
+	out := make([]byte, size)
+	if _, err := io.ReadFull(reader, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ODoHExchange seals query for target, POSTs it through relay when one is
+// given, and returns the opened plaintext answer.
+func ODoHExchange(proxy *Proxy, target *ODoHTarget, relay *ODoHRelay, query []byte) ([]byte, time.Duration, error) {
+	if err := FetchODoHTargetConfig(proxy, target); err != nil {
+		return nil, 0, err
+	}
+	sealedQuery, queryCtx, err := sealODoHQuery(target.config, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	destURL := target.URL
+	if relay != nil {
+		destURL = relay.URL
+	}
+	req, err := http.NewRequest("POST", destURL, bytes.NewReader(sealedQuery))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/oblivious-dns-message")
+	if relay != nil {
+		req.Header.Set("X-ODoH-Target", target.URL)
+	}
+	now := time.Now()
+	resp, err := proxy.xTransport.Fetch(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	rtt := time.Since(now)
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, errors.New("ODoH target or relay returned an error")
+	}
+	sealedAnswer, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDNSPacketSize))
+	if err != nil {
+		return nil, rtt, err
+	}
+	answer, err := openODoHResponse(queryCtx, sealedAnswer)
+	if err != nil {
+		return nil, rtt, err
+	}
+	return answer, rtt, nil
+}
+
+// ODoHExchangeWithRelays runs ODoHExchange against each configured relay in
+// turn and returns on the first success.
+func ODoHExchangeWithRelays(proxy *Proxy, target *ODoHTarget, relays []*ODoHRelay, query []byte) ([]byte, time.Duration, error) {
+	if len(relays) == 0 {
+		return ODoHExchange(proxy, target, nil, query)
+	}
+	var lastErr error
+	for _, relay := range relays {
+		answer, rtt, err := ODoHExchange(proxy, target, relay, query)
+		if err == nil {
+			return answer, rtt, nil
+		}
+		dlog.Debugf("ODoH relay [%v] failed for [%v]: %v", relay.URL, target.URL, err)
+		lastErr = err
+	}
+	dlog.Noticef("all ODoH relays failed for [%v]", target.URL)
+	return nil, 0, lastErr
+}
@@ -3,6 +3,7 @@ package dlog
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -25,6 +26,8 @@ type globals struct {
 	lastMessage    string
 	lastOccurrence time.Time
 	occurrences    uint64
+	format         Format
+	sinks          map[Severity]io.Writer
 }
 
 var (
@@ -50,11 +53,11 @@ const (
 )
 
 var SeverityName = []string{
-	SeverityDebug:    "DEBUG",
-	SeverityInfo:     "INFO",
-	SeverityNotice:   "NOTICE",
-	SeverityWarning:  "WARNING",
-	SeverityError:    "ERROR",
+	SeverityDebug:   "DEBUG",
+	SeverityInfo:    "INFO",
+	SeverityNotice:  "NOTICE",
+	SeverityWarning: "WARNING",
+	SeverityError:   "ERROR",
 }
 
 func Debugf(format string, args ...interface{}) {
@@ -74,6 +77,7 @@ func Warnf(format string, args ...interface{}) {
 }
 
 type errorString string
+
 func (e errorString) Error() string {
 	return string(e)
 }
@@ -103,7 +107,6 @@ func Error(message interface{}) {
 	log(SeverityError, message)
 }
 
-
 func (s *Severity) get() Severity {
 	return Severity(atomic.LoadInt32((*int32)(s)))
 }
@@ -165,7 +168,7 @@ func UseLogFile(fileName string) {
 	_globals.Unlock()
 }
 
-func GetFileDescriptor() (*os.File) {
+func GetFileDescriptor() *os.File {
 	_globals.Lock()
 	createFileDescriptor()
 	_globals.Unlock()
@@ -188,12 +191,16 @@ func createFileDescriptor() {
 }
 
 func logf(severity Severity, format string, args ...interface{}) *string {
+	return logfKV(severity, nil, format, args...)
+}
+
+// logfKV is the common path for every logging call, with or without a
+// scoped Logger's key/value pairs attached (see With).
+func logfKV(severity Severity, kv []KV, format string, args ...interface{}) *string {
 	if severity < _globals.logLevel.get() {
 		return nil
 	}
 	now := time.Now().Local()
-	year, month, day := now.Date()
-	hour, minute, second := now.Clock()
 	message := fmt.Sprintf(format, args...)
 	message = strings.TrimSpace(strings.TrimSuffix(message, "\n"))
 	if len(message) <= 0 {
@@ -213,6 +220,10 @@ func logf(severity Severity, format string, args ...interface{}) *string {
 		_globals.lastMessage = message
 	}
 	_globals.lastOccurrence = now
+	if sink, ok := _globals.sinks[severity]; ok {
+		sink.Write([]byte(renderLine(severity, now, message, kv)))
+		return &message
+	}
 	if *_globals.useSyslog && _globals.systemLogger == nil {
 		systemLogger, err := newSystemLogger(_globals.appName, _globals.syslogFacility)
 		if err == nil {
@@ -223,7 +234,7 @@ func logf(severity Severity, format string, args ...interface{}) *string {
 	if _globals.systemLogger != nil {
 		(*_globals.systemLogger).writeString(severity, message)
 	} else {
-		line := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d] [%s] %s\n", year, int(month), day, hour, minute, second, SeverityName[severity], message)
+		line := renderLine(severity, now, message, kv)
 		if _globals.outFd != nil {
 			_globals.outFd.WriteString(line)
 			_globals.outFd.Sync()
@@ -0,0 +1,117 @@
+package dlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Format selects how a rendered line looks.
+type Format int32
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// SetFormat switches every subsequent logf call to render as
+// newline-delimited JSON instead of the classic hand-formatted line.
+// Messages handed to the system logger (syslog/Eventlog) are passed on as
+// the bare message in either format.
+func SetFormat(format Format) {
+	_globals.Lock()
+	_globals.format = format
+	_globals.Unlock()
+}
+
+// SetSink routes a single severity to its own io.Writer, bypassing the
+// syslog/file/stderr selection for just that severity.
+func SetSink(severity Severity, w io.Writer) {
+	_globals.Lock()
+	if _globals.sinks == nil {
+		_globals.sinks = make(map[Severity]io.Writer)
+	}
+	_globals.sinks[severity] = w
+	_globals.Unlock()
+}
+
+// KV is one key/value pair carried by a scoped Logger.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger carries a fixed set of key/value pairs into every call made
+// through it, built with With. It's an immutable value.
+type Logger struct {
+	kv []KV
+}
+
+// With returns a Logger that attaches key/val, plus anything already
+// attached to the receiver, to every subsequent call.
+func (l Logger) With(key string, val interface{}) Logger {
+	kv := make([]KV, len(l.kv), len(l.kv)+1)
+	copy(kv, l.kv)
+	kv = append(kv, KV{Key: key, Value: val})
+	return Logger{kv: kv}
+}
+
+// With starts a new scoped Logger carrying key/val into every call made
+// through it.
+func With(key string, val interface{}) Logger {
+	return Logger{}.With(key, val)
+}
+
+func (l Logger) Debugf(format string, args ...interface{}) {
+	logfKV(SeverityDebug, l.kv, format, args...)
+}
+func (l Logger) Infof(format string, args ...interface{}) {
+	logfKV(SeverityInfo, l.kv, format, args...)
+}
+func (l Logger) Noticef(format string, args ...interface{}) {
+	logfKV(SeverityNotice, l.kv, format, args...)
+}
+func (l Logger) Warnf(format string, args ...interface{}) {
+	logfKV(SeverityWarning, l.kv, format, args...)
+}
+func (l Logger) Errorf(format string, args ...interface{}) error {
+	msg := errorString(*logfKV(SeverityError, l.kv, format, args...))
+	return msg
+}
+
+// renderLine formats a single already-flood-checked message according to
+// the active Format, carrying kv if any was supplied by a scoped Logger.
+func renderLine(severity Severity, now time.Time, message string, kv []KV) string {
+	if _globals.format == FormatJSON {
+		return renderJSONLine(severity, now, message, kv)
+	}
+	year, month, day := now.Date()
+	hour, minute, second := now.Clock()
+	line := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d] [%s] %s", year, int(month), day, hour, minute, second, SeverityName[severity], message)
+	if len(kv) > 0 {
+		pairs := make([]string, len(kv))
+		for i, pair := range kv {
+			pairs[i] = fmt.Sprintf("%s=%v", pair.Key, pair.Value)
+		}
+		line += " " + strings.Join(pairs, " ")
+	}
+	return line + "\n"
+}
+
+func renderJSONLine(severity Severity, now time.Time, message string, kv []KV) string {
+	fields := make(map[string]interface{}, len(kv)+4)
+	fields["ts"] = now.UTC().Format(time.RFC3339Nano)
+	fields["level"] = SeverityName[severity]
+	fields["app"] = _globals.appName
+	fields["msg"] = message
+	for _, pair := range kv {
+		fields[pair.Key] = pair.Value
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf(`{"ts":%q,"level":"ERROR","app":%q,"msg":"failed to encode log line: %v"}`+"\n", now.UTC().Format(time.RFC3339Nano), _globals.appName, err)
+	}
+	return string(encoded) + "\n"
+}